@@ -1,20 +1,28 @@
 package checkcloudwatchlogs
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/md5"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
 	"github.com/aws/aws-sdk-go/service/cloudwatchlogs/cloudwatchlogsiface"
+	"github.com/aws/aws-sdk-go/service/kinesis"
+	"github.com/aws/aws-sdk-go/service/kinesis/kinesisiface"
 	"github.com/jessevdk/go-flags"
 
 	"github.com/mackerelio/checkers"
@@ -25,15 +33,33 @@ type logOpts struct {
 	Region          string `long:"region" value-name:"REGION" description:"AWS Region"`
 	AccessKeyID     string `long:"access-key-id" value-name:"ACCESS-KEY-ID" description:"AWS Access Key ID"`
 	SecretAccessKey string `long:"secret-access-key" value-name:"SECRET-ACCESS-KEY" description:"AWS Secret Access Key"`
-	LogGroupName    string `long:"log-group-name" required:"true" value-name:"LOG-GROUP-NAME" description:"Log group name"`
+	LogGroupName    string `long:"log-group-name" value-name:"LOG-GROUP-NAME" description:"Log group name"`
 
-	Pattern       string `short:"p" long:"pattern" required:"true" value-name:"PATTERN" description:"Pattern to search for. The value is recognized as the pattern syntax of CloudWatch Logs."`
+	Pattern       string `short:"p" long:"pattern" value-name:"PATTERN" description:"Pattern to search for (required when --source=cloudwatch-logs). The value is recognized as the pattern syntax of CloudWatch Logs."`
 	WarningOver   int    `short:"w" long:"warning-over" value-name:"WARNING" description:"Trigger a warning if matched lines is over a number"`
 	CriticalOver  int    `short:"c" long:"critical-over" value-name:"CRITICAL" description:"Trigger a critical if matched lines is over a number"`
 	StateDir      string `short:"s" long:"state-dir" value-name:"DIR" description:"Dir to keep state files under"`
 	ReturnContent bool   `short:"r" long:"return" description:"Output matched lines"`
+
+	Source            string `long:"source" default:"cloudwatch-logs" value-name:"SOURCE" description:"Where to read log events from: cloudwatch-logs or kinesis"`
+	StreamName        string `long:"stream-name" value-name:"STREAM-NAME" description:"Kinesis Data Stream name (required when --source=kinesis)"`
+	ConsumerName      string `long:"consumer-name" value-name:"CONSUMER-NAME" description:"Name to register as an enhanced fan-out consumer (enables enhanced fan-out mode)"`
+	ShardIteratorType string `long:"shard-iterator-type" default:"LATEST" value-name:"TYPE" description:"Shard iterator type used for the first read of each shard, in shard mode and in enhanced fan-out mode (TRIM_HORIZON, LATEST, AT_TIMESTAMP)"`
+	KinesisPattern    string `long:"kinesis-pattern" value-name:"REGEX" description:"Go regexp to match against decoded Kinesis record lines (required when --source=kinesis). --pattern is not used here: it is CloudWatch Logs' server-side filter-pattern syntax, which Kinesis records are never evaluated against"`
+	StartTimestamp    *int64 `long:"start-timestamp" value-name:"UNIX-MS" description:"Unix ms timestamp to start reading from; required when --shard-iterator-type=AT_TIMESTAMP"`
+
+	Extract       string   `long:"extract" value-name:"JSONPATH" description:"JSONPath expression (e.g. $.duration_ms) extracting a numeric field from each matched event's Message; switches to evaluating the aggregate instead of the message count"`
+	Aggregation   string   `long:"aggregation" default:"sum" value-name:"FUNC" description:"How to aggregate extracted values across the polling window: sum, avg, max, p95"`
+	WarningValue  *float64 `long:"warning-value" value-name:"WARNING" description:"Trigger a warning if the aggregate value is over this number"`
+	CriticalValue *float64 `long:"critical-value" value-name:"CRITICAL" description:"Trigger a critical if the aggregate value is over this number"`
+	DeltaWarning  *float64 `long:"delta-warning" value-name:"DELTA" description:"Trigger a warning if the aggregate changes by more than this amount since the last run"`
 }
 
+const (
+	sourceCloudWatchLogs = "cloudwatch-logs"
+	sourceKinesis        = "kinesis"
+)
+
 // Do the plugin
 func Do() {
 	ckr := run(os.Args[1:])
@@ -42,15 +68,42 @@ func Do() {
 }
 
 type cloudwatchLogsPlugin struct {
-	Service   cloudwatchlogsiface.CloudWatchLogsAPI
-	StateFile string
+	Service        cloudwatchlogsiface.CloudWatchLogsAPI
+	KinesisService kinesisiface.KinesisAPI
+	StateFile      string
 	*logOpts
 }
 
 func newCloudwatchLogsPlugin(opts *logOpts, args []string) (*cloudwatchLogsPlugin, error) {
 	var err error
 	p := &cloudwatchLogsPlugin{logOpts: opts}
-	p.Service, err = createService(opts)
+	switch p.Source {
+	case "", sourceCloudWatchLogs:
+		p.Source = sourceCloudWatchLogs
+		if p.LogGroupName == "" {
+			return nil, fmt.Errorf("--log-group-name is required when --source=%s", sourceCloudWatchLogs)
+		}
+		if p.Pattern == "" {
+			return nil, fmt.Errorf("--pattern is required when --source=%s", sourceCloudWatchLogs)
+		}
+		p.Service, err = createService(opts)
+	case sourceKinesis:
+		if p.StreamName == "" {
+			return nil, fmt.Errorf("--stream-name is required when --source=%s", sourceKinesis)
+		}
+		if p.KinesisPattern == "" {
+			return nil, fmt.Errorf("--kinesis-pattern is required when --source=%s (--pattern is CloudWatch Logs' filter-pattern syntax, which does not apply to Kinesis records)", sourceKinesis)
+		}
+		if _, err := regexp.Compile(p.KinesisPattern); err != nil {
+			return nil, fmt.Errorf("invalid --kinesis-pattern: %v", err)
+		}
+		if p.ShardIteratorType == "AT_TIMESTAMP" && p.StartTimestamp == nil {
+			return nil, fmt.Errorf("--start-timestamp is required when --shard-iterator-type=AT_TIMESTAMP")
+		}
+		p.KinesisService, err = createKinesisService(opts)
+	default:
+		return nil, fmt.Errorf("unknown --source %q, must be %q or %q", p.Source, sourceCloudWatchLogs, sourceKinesis)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -58,7 +111,11 @@ func newCloudwatchLogsPlugin(opts *logOpts, args []string) (*cloudwatchLogsPlugi
 		workdir := pluginutil.PluginWorkDir()
 		p.StateDir = filepath.Join(workdir, "check-cloudwatch-logs")
 	}
-	p.StateFile = getStateFile(p.StateDir, opts.LogGroupName, args)
+	stateKey := opts.LogGroupName
+	if p.Source == sourceKinesis {
+		stateKey = opts.StreamName
+	}
+	p.StateFile = getStateFile(p.StateDir, stateKey, args)
 	return p, nil
 }
 
@@ -92,12 +149,47 @@ func createService(opts *logOpts) (*cloudwatchlogs.CloudWatchLogs, error) {
 	return cloudwatchlogs.New(sess, config), nil
 }
 
+func createKinesisService(opts *logOpts) (*kinesis.Kinesis, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+	config := aws.NewConfig()
+	if opts.AccessKeyID != "" && opts.SecretAccessKey != "" {
+		config = config.WithCredentials(
+			credentials.NewStaticCredentials(opts.AccessKeyID, opts.SecretAccessKey, ""),
+		)
+	}
+	if opts.Region != "" {
+		config = config.WithRegion(opts.Region)
+	}
+	return kinesis.New(sess, config), nil
+}
+
+// shardState tracks the per-shard read position of a Kinesis Data Stream,
+// the Kinesis analogue of the single NextToken/StartTime pair used for
+// FilterLogEvents.
+type shardState struct {
+	Sequence  *string
+	Timestamp *int64
+}
+
 type logState struct {
 	NextToken *string
 	StartTime *int64
+
+	Shards map[string]*shardState
+
+	// LastAggregate is the last metric-filter aggregate computed by
+	// checkMetric, kept across runs so --delta-warning can alert on the
+	// rate of change rather than the absolute value.
+	LastAggregate *float64
 }
 
 func (p *cloudwatchLogsPlugin) run() ([]string, error) {
+	if p.Source == sourceKinesis {
+		return p.runKinesis()
+	}
 	var nextToken *string
 	var startTime *int64
 	s, err := p.loadState()
@@ -136,7 +228,12 @@ func (p *cloudwatchLogsPlugin) run() ([]string, error) {
 		time.Sleep(250 * time.Millisecond)
 	}
 	if nextToken != nil {
-		err := p.saveState(&logState{nextToken, startTime})
+		if s == nil {
+			s = &logState{}
+		}
+		s.NextToken = nextToken
+		s.StartTime = startTime
+		err := p.saveState(s)
 		if err != nil {
 			return nil, err
 		}
@@ -144,6 +241,357 @@ func (p *cloudwatchLogsPlugin) run() ([]string, error) {
 	return messages, nil
 }
 
+// runKinesis consumes records from a Kinesis Data Stream instead of
+// FilterLogEvents, in either shard-iterator mode or enhanced fan-out mode.
+func (p *cloudwatchLogsPlugin) runKinesis() ([]string, error) {
+	shards, err := p.loadShardStates()
+	if err != nil {
+		return nil, err
+	}
+	var records [][]byte
+	if p.ConsumerName != "" {
+		records, err = p.runKinesisEnhancedFanOut(shards)
+	} else {
+		records, err = p.runKinesisShards(shards)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := p.saveShardStates(shards); err != nil {
+		return nil, err
+	}
+	return p.decodeRecords(records)
+}
+
+func (p *cloudwatchLogsPlugin) loadShardStates() (map[string]*shardState, error) {
+	s, err := p.loadState()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return map[string]*shardState{}, nil
+		}
+		return nil, err
+	}
+	if s.Shards == nil {
+		return map[string]*shardState{}, nil
+	}
+	return s.Shards, nil
+}
+
+// saveShardStates load-modify-saves the Shards field so it doesn't clobber
+// LastAggregate (or any other state) a concurrent mode may have persisted.
+func (p *cloudwatchLogsPlugin) saveShardStates(shards map[string]*shardState) error {
+	s, err := p.loadState()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		s = &logState{}
+	}
+	s.Shards = shards
+	return p.saveState(s)
+}
+
+// startTimestampTime converts --start-timestamp (unix ms) into the *time.Time
+// the Kinesis API expects for an AT_TIMESTAMP shard iterator.
+func startTimestampTime(unixMillis *int64) *time.Time {
+	return aws.Time(time.Unix(0, *unixMillis*int64(time.Millisecond)))
+}
+
+// runKinesisShards iterates DescribeStream shards and pulls records with
+// GetRecords, one per-shard iterator per shard, advancing each shard's
+// sequence number as records are read.
+func (p *cloudwatchLogsPlugin) runKinesisShards(shards map[string]*shardState) ([][]byte, error) {
+	var shardIDs []string
+	var exclusiveStartShardID *string
+	for {
+		out, err := p.KinesisService.DescribeStream(&kinesis.DescribeStreamInput{
+			StreamName:            aws.String(p.StreamName),
+			ExclusiveStartShardId: exclusiveStartShardID,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, sh := range out.StreamDescription.Shards {
+			shardIDs = append(shardIDs, *sh.ShardId)
+		}
+		if !aws.BoolValue(out.StreamDescription.HasMoreShards) {
+			break
+		}
+		exclusiveStartShardID = out.StreamDescription.Shards[len(out.StreamDescription.Shards)-1].ShardId
+	}
+
+	var records [][]byte
+	for _, shardID := range shardIDs {
+		st, ok := shards[shardID]
+		if !ok {
+			st = &shardState{}
+			shards[shardID] = st
+		}
+		iteratorInput := &kinesis.GetShardIteratorInput{
+			StreamName: aws.String(p.StreamName),
+			ShardId:    aws.String(shardID),
+		}
+		if st.Sequence != nil {
+			iteratorInput.ShardIteratorType = aws.String("AFTER_SEQUENCE_NUMBER")
+			iteratorInput.StartingSequenceNumber = st.Sequence
+		} else {
+			iteratorInput.ShardIteratorType = aws.String(p.ShardIteratorType)
+			if p.ShardIteratorType == "AT_TIMESTAMP" {
+				iteratorInput.Timestamp = startTimestampTime(p.StartTimestamp)
+			}
+		}
+		iterOut, err := p.KinesisService.GetShardIterator(iteratorInput)
+		if err != nil {
+			return nil, err
+		}
+		shardIterator := iterOut.ShardIterator
+		for shardIterator != nil {
+			out, err := p.KinesisService.GetRecords(&kinesis.GetRecordsInput{
+				ShardIterator: shardIterator,
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range out.Records {
+				records = append(records, r.Data)
+				st.Sequence = r.SequenceNumber
+				st.Timestamp = aws.Int64(r.ApproximateArrivalTimestamp.Unix() * 1000)
+			}
+			if len(out.Records) == 0 {
+				break
+			}
+			shardIterator = out.NextShardIterator
+			time.Sleep(250 * time.Millisecond)
+		}
+	}
+	return records, nil
+}
+
+// runKinesisEnhancedFanOut registers (or reuses) a stream consumer and reads
+// records over the dedicated throughput of SubscribeToShard, tearing the
+// consumer back down on the way out.
+func (p *cloudwatchLogsPlugin) runKinesisEnhancedFanOut(shards map[string]*shardState) ([][]byte, error) {
+	streamOut, err := p.KinesisService.DescribeStream(&kinesis.DescribeStreamInput{
+		StreamName: aws.String(p.StreamName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	streamARN := streamOut.StreamDescription.StreamARN
+
+	consumerARN, err := p.ensureStreamConsumer(streamARN)
+	if err != nil {
+		return nil, err
+	}
+	defer p.deregisterStreamConsumer(streamARN, consumerARN)
+
+	if err := p.waitForConsumerActive(consumerARN); err != nil {
+		return nil, err
+	}
+
+	var records [][]byte
+	for _, sh := range streamOut.StreamDescription.Shards {
+		shardID := *sh.ShardId
+		st, ok := shards[shardID]
+		if !ok {
+			st = &shardState{}
+			shards[shardID] = st
+		}
+		pos := &kinesis.StartingPosition{Type: aws.String(p.ShardIteratorType)}
+		if st.Sequence != nil {
+			pos.Type = aws.String("AFTER_SEQUENCE_NUMBER")
+			pos.SequenceNumber = st.Sequence
+		} else if p.ShardIteratorType == "AT_TIMESTAMP" {
+			pos.Timestamp = startTimestampTime(p.StartTimestamp)
+		}
+		subOut, err := p.KinesisService.SubscribeToShard(&kinesis.SubscribeToShardInput{
+			ConsumerARN:      consumerARN,
+			ShardId:          aws.String(shardID),
+			StartingPosition: pos,
+		})
+		if err != nil {
+			return nil, err
+		}
+		shardRecords, err := drainSubscription(subOut, fanOutReadWindow)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range shardRecords {
+			records = append(records, r.Data)
+			st.Sequence = r.SequenceNumber
+			st.Timestamp = aws.Int64(r.ApproximateArrivalTimestamp.Unix() * 1000)
+		}
+	}
+	return records, nil
+}
+
+// ensureStreamConsumer registers --consumer-name, or reuses it if it's
+// already registered. A consumer can already be registered because a prior
+// invocation of this one-shot CLI was killed or timed out before its
+// deferred deregister ran; without this fallback every later run would fail
+// outright with ResourceInUseException and never recover.
+func (p *cloudwatchLogsPlugin) ensureStreamConsumer(streamARN *string) (*string, error) {
+	describeInput := &kinesis.DescribeStreamConsumerInput{
+		StreamARN:    streamARN,
+		ConsumerName: aws.String(p.ConsumerName),
+	}
+	if out, err := p.KinesisService.DescribeStreamConsumer(describeInput); err == nil {
+		return out.ConsumerDescription.ConsumerARN, nil
+	}
+
+	consumer, err := p.KinesisService.RegisterStreamConsumer(&kinesis.RegisterStreamConsumerInput{
+		StreamARN:    streamARN,
+		ConsumerName: aws.String(p.ConsumerName),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == kinesis.ErrCodeResourceInUseException {
+			// Lost a race against another run registering it first; look
+			// up the ARN it ended up with instead of failing.
+			if out, describeErr := p.KinesisService.DescribeStreamConsumer(describeInput); describeErr == nil {
+				return out.ConsumerDescription.ConsumerARN, nil
+			}
+		}
+		return nil, err
+	}
+	return consumer.Consumer.ConsumerARN, nil
+}
+
+// fanOutReadWindow bounds how long each shard's SubscribeToShard
+// subscription is drained for. AWS keeps an enhanced fan-out subscription
+// open for up to 5 minutes before closing it server-side; a periodic check
+// (run e.g. once a minute by a check runner) can't afford to block that
+// long, so each invocation only takes whatever arrives within this window
+// and leaves the rest for the next run.
+const fanOutReadWindow = 5 * time.Second
+
+// drainSubscription reads events from subOut for up to window and returns
+// the accumulated records, then closes the event stream. It returns
+// whatever was read so far rather than waiting for AWS to close the stream.
+func drainSubscription(subOut *kinesis.SubscribeToShardOutput, window time.Duration) ([]*kinesis.Record, error) {
+	var records []*kinesis.Record
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for event := range subOut.EventStream.Events() {
+			e, ok := event.(*kinesis.SubscribeToShardEvent)
+			if !ok {
+				continue
+			}
+			records = append(records, e.Records...)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(window):
+	}
+	subOut.EventStream.Close()
+	<-done
+
+	if err := subOut.EventStream.Err(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (p *cloudwatchLogsPlugin) waitForConsumerActive(consumerARN *string) error {
+	deadline := time.Now().Add(2 * time.Minute)
+	for {
+		out, err := p.KinesisService.DescribeStreamConsumer(&kinesis.DescribeStreamConsumerInput{
+			ConsumerARN: consumerARN,
+		})
+		if err != nil {
+			return err
+		}
+		if aws.StringValue(out.ConsumerDescription.ConsumerStatus) == kinesis.ConsumerStatusActive {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for consumer %s to become active", aws.StringValue(consumerARN))
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// deregisterStreamConsumer tears down the enhanced fan-out consumer and
+// polls DescribeStreamConsumer until it reports the consumer gone, mirroring
+// the wait-then-timeout pattern used elsewhere for consumer lifecycle changes.
+func (p *cloudwatchLogsPlugin) deregisterStreamConsumer(streamARN, consumerARN *string) {
+	_, err := p.KinesisService.DeregisterStreamConsumer(&kinesis.DeregisterStreamConsumerInput{
+		StreamARN:   streamARN,
+		ConsumerARN: consumerARN,
+	})
+	if err != nil {
+		return
+	}
+	deadline := time.Now().Add(time.Minute)
+	for time.Now().Before(deadline) {
+		_, err := p.KinesisService.DescribeStreamConsumer(&kinesis.DescribeStreamConsumerInput{
+			ConsumerARN: consumerARN,
+		})
+		if err != nil {
+			return
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// decodeRecords decodes each raw Kinesis record and evaluates the pattern
+// against it. CloudWatch Logs subscription filters deliver gzip-compressed
+// JSON to Kinesis, so each record is gunzipped (when it looks gzipped) before
+// its subscription filter log events are matched one by one; any other record
+// is matched as a single raw line, without splitting it on newlines.
+func (p *cloudwatchLogsPlugin) decodeRecords(records [][]byte) ([]string, error) {
+	re, err := regexp.Compile(p.KinesisPattern)
+	if err != nil {
+		return nil, err
+	}
+	var messages []string
+	for _, data := range records {
+		data, err := maybeGunzip(data)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range decodeLogEventLines(data) {
+			if re.MatchString(line) {
+				messages = append(messages, line)
+			}
+		}
+	}
+	return messages, nil
+}
+
+func maybeGunzip(data []byte) ([]byte, error) {
+	if len(data) < 2 || data[0] != 0x1f || data[1] != 0x8b {
+		return data, nil
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
+
+// decodeLogEventLines decodes a CloudWatch Logs subscription filter payload
+// (one JSON document containing a logEvents array) when possible, falling
+// back to treating the payload as a single raw line.
+func decodeLogEventLines(data []byte) []string {
+	var payload struct {
+		LogEvents []struct {
+			Message string `json:"message"`
+		} `json:"logEvents"`
+	}
+	if err := json.Unmarshal(data, &payload); err == nil && len(payload.LogEvents) > 0 {
+		lines := make([]string, len(payload.LogEvents))
+		for i, e := range payload.LogEvents {
+			lines[i] = e.Message
+		}
+		return lines
+	}
+	return []string{string(data)}
+}
+
 func (p *cloudwatchLogsPlugin) loadState() (*logState, error) {
 	f, err := os.Open(p.StateFile)
 	if err != nil {
@@ -181,7 +629,7 @@ func (p *cloudwatchLogsPlugin) check(messages []string) *checkers.Checker {
 		status = checkers.WARNING
 		msg += " > " + fmt.Sprint(p.WarningOver)
 	}
-	msg += " messages for pattern /" + p.Pattern + "/"
+	msg += " messages for pattern /" + p.displayPattern() + "/"
 	if messages != nil {
 		if p.ReturnContent {
 			msg += "\n" + strings.Join(messages, "")
@@ -191,6 +639,167 @@ func (p *cloudwatchLogsPlugin) check(messages []string) *checkers.Checker {
 	return checkers.NewChecker(checkers.OK, msg)
 }
 
+// displayPattern returns the pattern that was actually matched against,
+// which depends on --source: cloudwatch-logs events are matched server-side
+// by --pattern, while Kinesis records are matched locally by
+// --kinesis-pattern.
+func (p *cloudwatchLogsPlugin) displayPattern() string {
+	if p.Source == sourceKinesis {
+		return p.KinesisPattern
+	}
+	return p.Pattern
+}
+
+// checkMetric treats the pattern as a metric-filter expression over
+// structured (JSON) events: each matched event's Message is decoded as
+// JSON, p.Extract is applied to pull out a numeric field, and the
+// aggregate across the polling window (not len(messages)) is compared
+// against the thresholds.
+func (p *cloudwatchLogsPlugin) checkMetric(messages []string) *checkers.Checker {
+	values, err := p.extractValues(messages)
+	if err != nil {
+		return checkers.NewChecker(checkers.UNKNOWN, fmt.Sprint(err))
+	}
+	aggregate, err := aggregateValues(values, p.Aggregation)
+	if err != nil {
+		return checkers.NewChecker(checkers.UNKNOWN, fmt.Sprint(err))
+	}
+
+	status := checkers.OK
+	msg := fmt.Sprintf("%s(%s) = %g", p.Aggregation, p.Extract, aggregate)
+	if p.CriticalValue != nil && aggregate > *p.CriticalValue {
+		status = checkers.CRITICAL
+		msg += fmt.Sprintf(" > %g", *p.CriticalValue)
+	} else if p.WarningValue != nil && aggregate > *p.WarningValue {
+		status = checkers.WARNING
+		msg += fmt.Sprintf(" > %g", *p.WarningValue)
+	}
+
+	last, err := p.lastAggregate()
+	if err != nil {
+		return checkers.NewChecker(checkers.UNKNOWN, fmt.Sprint(err))
+	}
+	if p.DeltaWarning != nil && last != nil {
+		if delta := aggregate - *last; math.Abs(delta) > *p.DeltaWarning {
+			if status < checkers.WARNING {
+				status = checkers.WARNING
+			}
+			msg += fmt.Sprintf(", delta %+g > %g", delta, *p.DeltaWarning)
+		}
+	}
+
+	if err := p.saveLastAggregate(aggregate); err != nil {
+		return checkers.NewChecker(checkers.UNKNOWN, fmt.Sprint(err))
+	}
+	if p.ReturnContent && messages != nil {
+		msg += "\n" + strings.Join(messages, "")
+	}
+	return checkers.NewChecker(status, msg)
+}
+
+func (p *cloudwatchLogsPlugin) extractValues(messages []string) ([]float64, error) {
+	var values []float64
+	for _, m := range messages {
+		v, ok, err := extractJSONPath([]byte(m), p.Extract)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
+
+// extractJSONPath resolves a minimal dot-separated JSONPath of the form
+// "$.foo.bar" against a JSON document, returning false when the document
+// doesn't parse or the path doesn't resolve to a number.
+func extractJSONPath(data []byte, path string) (float64, bool, error) {
+	path = strings.TrimPrefix(path, "$.")
+	path = strings.TrimPrefix(path, "$")
+	if path == "" {
+		return 0, false, fmt.Errorf("invalid --extract %q", path)
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return 0, false, nil
+	}
+	cur := doc
+	for _, key := range strings.Split(path, ".") {
+		m, ok := cur.(map[string]interface{})
+		if !ok {
+			return 0, false, nil
+		}
+		cur, ok = m[key]
+		if !ok {
+			return 0, false, nil
+		}
+	}
+	v, ok := cur.(float64)
+	return v, ok, nil
+}
+
+func aggregateValues(values []float64, method string) (float64, error) {
+	if len(values) == 0 {
+		return 0, nil
+	}
+	switch method {
+	case "", "sum":
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum, nil
+	case "avg":
+		var sum float64
+		for _, v := range values {
+			sum += v
+		}
+		return sum / float64(len(values)), nil
+	case "max":
+		max := values[0]
+		for _, v := range values[1:] {
+			if v > max {
+				max = v
+			}
+		}
+		return max, nil
+	case "p95":
+		sorted := append([]float64(nil), values...)
+		sort.Float64s(sorted)
+		idx := int(math.Ceil(0.95*float64(len(sorted)))) - 1
+		if idx < 0 {
+			idx = 0
+		}
+		return sorted[idx], nil
+	default:
+		return 0, fmt.Errorf("unknown --aggregation %q", method)
+	}
+}
+
+func (p *cloudwatchLogsPlugin) lastAggregate() (*float64, error) {
+	s, err := p.loadState()
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return s.LastAggregate, nil
+}
+
+func (p *cloudwatchLogsPlugin) saveLastAggregate(v float64) error {
+	s, err := p.loadState()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		s = &logState{}
+	}
+	s.LastAggregate = &v
+	return p.saveState(s)
+}
+
 func run(args []string) *checkers.Checker {
 	opts := &logOpts{}
 	_, err := flags.ParseArgs(opts, args)
@@ -205,5 +814,8 @@ func run(args []string) *checkers.Checker {
 	if err != nil {
 		return checkers.NewChecker(checkers.UNKNOWN, fmt.Sprint(err))
 	}
+	if p.Extract != "" {
+		return p.checkMetric(messages)
+	}
 	return p.check(messages)
 }
@@ -1,15 +1,22 @@
 package checkmysql
 
 import (
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"database/sql"
+	"encoding/pem"
 	"fmt"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
 
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/rds/rdsutils"
 	"github.com/go-ini/ini"
 	"github.com/go-sql-driver/mysql"
+	"github.com/jessevdk/go-flags"
 	"github.com/mackerelio/checkers"
 )
 
@@ -25,6 +32,11 @@ type mysqlSetting struct {
 	EnableTLS     bool   `long:"tls" description:"Enables TLS connection"`
 	TLSRootCert   string `long:"tls-root-cert" default:"" description:"The root certificate used for TLS certificate verification"`
 	TLSSkipVerify bool   `long:"tls-skip-verify" description:"Disable TLS certificate verification"`
+
+	Auth            string `long:"auth" default:"" value-name:"AUTH" description:"Authentication mode: empty for password auth, \"iam\" to authenticate with a short-lived AWS RDS/Aurora IAM auth token"`
+	AuthPlugin      string `long:"auth-plugin" default:"" value-name:"PLUGIN" description:"MySQL auth plugin to expect: mysql_native_password or caching_sha2_password"`
+	ServerPublicKey string `long:"server-public-key" default:"" value-name:"PATH" description:"Path to the server's RSA public key PEM, letting caching_sha2_password complete over a non-TLS connection or unix socket"`
+	Region          string `long:"region" default:"" value-name:"REGION" description:"AWS Region, required for --auth=iam"`
 }
 
 type mysqlVersion struct {
@@ -34,10 +46,12 @@ type mysqlVersion struct {
 }
 
 var commands = map[string](func([]string) *checkers.Checker){
-	"replication": checkReplication,
-	"connection":  checkConnection,
-	"uptime":      checkUptime,
-	"readonly":    checkReadOnly,
+	"replication":   checkReplication,
+	"connection":    checkConnection,
+	"uptime":        checkUptime,
+	"readonly":      checkReadOnly,
+	"slave-lag":     checkSlaveLag,
+	"innodb-status": checkInnodbStatus,
 }
 
 func readCnf(m mysqlSetting) (mysqlSetting, error) {
@@ -120,11 +134,30 @@ func newDB(m mysqlSetting) (*sql.DB, error) {
 	}
 
 	cfg := &mysql.Config{
-		User:                 m.User,
-		Passwd:               m.Pass,
-		Net:                  proto,
-		Addr:                 target,
-		AllowNativePasswords: true,
+		User:   m.User,
+		Passwd: m.Pass,
+		Net:    proto,
+		Addr:   target,
+	}
+	switch m.AuthPlugin {
+	case "caching_sha2_password":
+		// The driver decides for itself whether full authentication can
+		// send the password in the clear, based on TLS/unix-socket; over
+		// neither, it instead needs the server's RSA public key to
+		// encrypt the password, so require --server-public-key here.
+		if !m.EnableTLS && proto != "unix" && m.ServerPublicKey == "" {
+			return nil, fmt.Errorf("--server-public-key is required for --auth-plugin=caching_sha2_password without --tls or a unix socket")
+		}
+	default:
+		cfg.AllowNativePasswords = true
+	}
+	if m.ServerPublicKey != "" {
+		rsaPubKey, err := readRSAPublicKey(m.ServerPublicKey)
+		if err != nil {
+			return nil, err
+		}
+		mysql.RegisterServerPubKey("custom", rsaPubKey)
+		cfg.ServerPubKey = "custom"
 	}
 	if m.EnableTLS {
 		var c tls.Config
@@ -142,9 +175,52 @@ func newDB(m mysqlSetting) (*sql.DB, error) {
 		cfg.TLSConfig = "custom"
 	}
 
+	switch m.Auth {
+	case "", "password":
+	case "iam":
+		if !m.EnableTLS {
+			return nil, fmt.Errorf("--tls is required with --auth=iam")
+		}
+		if m.Region == "" {
+			return nil, fmt.Errorf("--region is required with --auth=iam")
+		}
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		token, err := rdsutils.BuildAuthToken(target, m.Region, m.User, sess.Config.Credentials)
+		if err != nil {
+			return nil, fmt.Errorf("cannot build RDS IAM auth token: %v", err)
+		}
+		cfg.Passwd = token
+		cfg.AllowCleartextPasswords = true
+	default:
+		return nil, fmt.Errorf("unknown --auth %q", m.Auth)
+	}
+
 	return sql.Open("mysql", cfg.FormatDSN())
 }
 
+func readRSAPublicKey(path string) (*rsa.PublicKey, error) {
+	pemBytes, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %v", path, err)
+	}
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, fmt.Errorf("cannot decode PEM in %s", path)
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse public key in %s: %v", path, err)
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s does not contain an RSA public key", path)
+	}
+	return rsaPub, nil
+}
+
 func getMySQLVersion(db *sql.DB) (*mysqlVersion, error) {
 	var rawVersion string
 	err := db.QueryRow("SELECT VERSION()").Scan(&rawVersion)
@@ -165,3 +241,230 @@ func getMySQLVersion(db *sql.DB) (*mysqlVersion, error) {
 		patch: patch,
 	}, nil
 }
+
+// atLeast reports whether v is >= major.minor.patch.
+func (v *mysqlVersion) atLeast(major, minor, patch int) bool {
+	if v.major != major {
+		return v.major > major
+	}
+	if v.minor != minor {
+		return v.minor > minor
+	}
+	return v.patch >= patch
+}
+
+// queryRowMap runs query, which must return at most one row, and returns
+// its columns keyed by name. It returns a nil map (and no error) when the
+// query returns no rows, e.g. SHOW SLAVE STATUS on a server that isn't a
+// replica.
+func queryRowMap(db *sql.DB, query string) (map[string]string, error) {
+	rows, err := db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	if !rows.Next() {
+		return nil, rows.Err()
+	}
+
+	values := make([]sql.NullString, len(cols))
+	scanArgs := make([]interface{}, len(cols))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+	if err := rows.Scan(scanArgs...); err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]string, len(cols))
+	for i, col := range cols {
+		row[col] = values[i].String
+	}
+	return row, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+type slaveLagOpts struct {
+	mysqlSetting
+	WarningSeconds  int  `short:"w" long:"warning" default:"60" description:"Seconds behind master/source to trigger a warning"`
+	CriticalSeconds int  `short:"c" long:"critical" default:"300" description:"Seconds behind master/source to trigger a critical"`
+	CheckRunning    bool `long:"check-running" description:"Also trigger a critical unless the IO/SQL (or source/replica) replication threads are Yes"`
+}
+
+// checkSlaveLag runs SHOW SLAVE STATUS (or SHOW REPLICA STATUS on
+// MySQL 8.0.22+, which renamed the terminology) and alerts on
+// Seconds_Behind_Master/Seconds_Behind_Source.
+func checkSlaveLag(args []string) *checkers.Checker {
+	opts := slaveLagOpts{}
+	_, err := flags.ParseArgs(&opts, args)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	db, err := newDB(opts.mysqlSetting)
+	if err != nil {
+		return checkers.NewChecker(checkers.UNKNOWN, fmt.Sprint(err))
+	}
+	defer db.Close()
+
+	version, err := getMySQLVersion(db)
+	if err != nil {
+		return checkers.NewChecker(checkers.UNKNOWN, fmt.Sprint(err))
+	}
+	query := "SHOW SLAVE STATUS"
+	if version.atLeast(8, 0, 22) {
+		query = "SHOW REPLICA STATUS"
+	}
+
+	row, err := queryRowMap(db, query)
+	if err != nil {
+		return checkers.NewChecker(checkers.UNKNOWN, fmt.Sprintf("Failed to query %s: %s", query, err))
+	}
+	if row == nil {
+		return checkers.NewChecker(checkers.CRITICAL, fmt.Sprintf("%s returned no rows; this server is not a replica", query))
+	}
+
+	lagStr := firstNonEmpty(row["Seconds_Behind_Master"], row["Seconds_Behind_Source"])
+	if lagStr == "" {
+		return checkers.NewChecker(checkers.CRITICAL, "Seconds_Behind_Master/Seconds_Behind_Source is NULL; replication is not running")
+	}
+	lag, err := strconv.Atoi(lagStr)
+	if err != nil {
+		return checkers.NewChecker(checkers.UNKNOWN, fmt.Sprintf("cannot parse replication lag %q: %s", lagStr, err))
+	}
+
+	status := checkers.OK
+	msg := fmt.Sprintf("%d seconds behind", lag)
+	if lag > opts.CriticalSeconds {
+		status = checkers.CRITICAL
+		msg += fmt.Sprintf(" > %d", opts.CriticalSeconds)
+	} else if lag > opts.WarningSeconds {
+		status = checkers.WARNING
+		msg += fmt.Sprintf(" > %d", opts.WarningSeconds)
+	}
+
+	if opts.CheckRunning {
+		ioRunning := firstNonEmpty(row["Slave_IO_Running"], row["Replica_IO_Running"])
+		sqlRunning := firstNonEmpty(row["Slave_SQL_Running"], row["Replica_SQL_Running"])
+		if ioRunning != "Yes" || sqlRunning != "Yes" {
+			status = checkers.CRITICAL
+			msg += fmt.Sprintf(", IO running=%s SQL running=%s", ioRunning, sqlRunning)
+		}
+	}
+
+	return checkers.NewChecker(status, msg)
+}
+
+var (
+	historyListLengthRe    = regexp.MustCompile(`History list length (\d+)`)
+	activeTransactionSecRe = regexp.MustCompile(`ACTIVE (\d+) sec`)
+	osWaitsRe              = regexp.MustCompile(`OS waits (\d+)`)
+)
+
+func parseHistoryListLength(status string) (int, bool) {
+	m := historyListLengthRe.FindStringSubmatch(status)
+	if m == nil {
+		return 0, false
+	}
+	n, err := strconv.Atoi(m[1])
+	return n, err == nil
+}
+
+func parseLongestActiveTransactionAge(status string) int {
+	longest := 0
+	for _, m := range activeTransactionSecRe.FindAllStringSubmatch(status, -1) {
+		if n, err := strconv.Atoi(m[1]); err == nil && n > longest {
+			longest = n
+		}
+	}
+	return longest
+}
+
+func parseSemaphoreWaitCount(status string) int {
+	total := 0
+	for _, m := range osWaitsRe.FindAllStringSubmatch(status, -1) {
+		if n, err := strconv.Atoi(m[1]); err == nil {
+			total += n
+		}
+	}
+	return total
+}
+
+// evalInnodbMetric formats value as a "name=value" message, escalating
+// status (without ever downgrading it) when value crosses warning/critical.
+func evalInnodbMetric(status checkers.Status, msgs []string, name string, value, warning, critical int) (checkers.Status, []string) {
+	msg := fmt.Sprintf("%s=%d", name, value)
+	switch {
+	case value > critical:
+		if checkers.CRITICAL > status {
+			status = checkers.CRITICAL
+		}
+		msg += fmt.Sprintf(" > %d", critical)
+	case value > warning:
+		if checkers.WARNING > status {
+			status = checkers.WARNING
+		}
+		msg += fmt.Sprintf(" > %d", warning)
+	}
+	return status, append(msgs, msg)
+}
+
+type innodbStatusOpts struct {
+	mysqlSetting
+	WarningHistoryLength   int `long:"warning-history-length" default:"1000" description:"InnoDB history list length to trigger a warning"`
+	CriticalHistoryLength  int `long:"critical-history-length" default:"10000" description:"InnoDB history list length to trigger a critical"`
+	WarningTransactionAge  int `long:"warning-transaction-age" default:"60" description:"Seconds the longest active transaction may run before triggering a warning"`
+	CriticalTransactionAge int `long:"critical-transaction-age" default:"300" description:"Seconds the longest active transaction may run before triggering a critical"`
+	WarningSemaphoreWaits  int `long:"warning-semaphore-waits" default:"10" description:"InnoDB semaphore OS wait count to trigger a warning"`
+	CriticalSemaphoreWaits int `long:"critical-semaphore-waits" default:"50" description:"InnoDB semaphore OS wait count to trigger a critical"`
+}
+
+// checkInnodbStatus parses SHOW ENGINE INNODB STATUS for the history list
+// length, the longest running active transaction, and the InnoDB semaphore
+// wait count, alerting on each against its own thresholds.
+func checkInnodbStatus(args []string) *checkers.Checker {
+	opts := innodbStatusOpts{}
+	_, err := flags.ParseArgs(&opts, args)
+	if err != nil {
+		os.Exit(1)
+	}
+
+	db, err := newDB(opts.mysqlSetting)
+	if err != nil {
+		return checkers.NewChecker(checkers.UNKNOWN, fmt.Sprint(err))
+	}
+	defer db.Close()
+
+	var typ, name, status string
+	if err := db.QueryRow("SHOW ENGINE INNODB STATUS").Scan(&typ, &name, &status); err != nil {
+		return checkers.NewChecker(checkers.UNKNOWN, fmt.Sprintf("Failed to query SHOW ENGINE INNODB STATUS: %s", err))
+	}
+
+	historyLength, ok := parseHistoryListLength(status)
+	if !ok {
+		return checkers.NewChecker(checkers.UNKNOWN, `cannot find "History list length" in SHOW ENGINE INNODB STATUS output`)
+	}
+	transactionAge := parseLongestActiveTransactionAge(status)
+	semaphoreWaits := parseSemaphoreWaitCount(status)
+
+	overall := checkers.OK
+	var msgs []string
+	overall, msgs = evalInnodbMetric(overall, msgs, "history list length", historyLength, opts.WarningHistoryLength, opts.CriticalHistoryLength)
+	overall, msgs = evalInnodbMetric(overall, msgs, "longest active transaction age", transactionAge, opts.WarningTransactionAge, opts.CriticalTransactionAge)
+	overall, msgs = evalInnodbMetric(overall, msgs, "semaphore waits", semaphoreWaits, opts.WarningSemaphoreWaits, opts.CriticalSemaphoreWaits)
+
+	return checkers.NewChecker(overall, strings.Join(msgs, ", "))
+}